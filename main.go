@@ -1,21 +1,43 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
+	"syscall"
 	"text/template"
+	"time"
 	"unicode/utf8"
+
+	"github.com/BurntSushi/toml"
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v2"
 )
 
 type errs []string
 
-type varset map[string]string
+type varset map[string]interface{}
+
+type token int
+
+const (
+	tIDENT token = iota
+	tSTRING
+	tLBRACK
+	tRBRACK
+)
 
 type source struct {
 	r           io.Reader
@@ -34,12 +56,66 @@ type scanner struct {
 	eof bool
 	key string
 	val string
+
+	section    string
+	subsection string
+	insection  bool
 }
 
 func isLetter(r rune) bool {
 	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '_' || r == '-'
 }
 
+func classify(r rune) token {
+	switch r {
+	case '[':
+		return tLBRACK
+	case ']':
+		return tRBRACK
+	case '"':
+		return tSTRING
+	default:
+		return tIDENT
+	}
+}
+
+// unquote supports \n, \t, \\, \" and a trailing backslash-newline for
+// line continuation.
+func unquote(s string) (string, error) {
+	var buf bytes.Buffer
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		if c != '\\' {
+			buf.WriteByte(c)
+			continue
+		}
+
+		i++
+
+		if i >= len(s) {
+			return "", errors.New("unterminated escape sequence")
+		}
+
+		switch s[i] {
+		case 'n':
+			buf.WriteByte('\n')
+		case 't':
+			buf.WriteByte('\t')
+		case '\\':
+			buf.WriteByte('\\')
+		case '"':
+			buf.WriteByte('"')
+		case '\n':
+			// line continuation, the newline itself is dropped
+		default:
+			return "", fmt.Errorf("unknown escape sequence \\%c", s[i])
+		}
+	}
+	return buf.String(), nil
+}
+
 func newSource(r io.Reader, errh func(int, int, string)) *source {
 	return &source{
 		r:    r,
@@ -145,6 +221,35 @@ func (sc *scanner) scankey() {
 	sc.key = sc.stopLit()
 }
 
+func (sc *scanner) scanstring() (string, bool) {
+	r := sc.get()
+
+	sc.startLit()
+
+	for {
+		if r == -1 {
+			return sc.stopLit(), false
+		}
+
+		if r == '"' {
+			sc.unget()
+			break
+		}
+
+		if r == '\\' {
+			if sc.get() == -1 {
+				return sc.stopLit(), false
+			}
+		}
+
+		r = sc.get()
+	}
+
+	lit := sc.stopLit()
+	sc.get()
+	return lit, true
+}
+
 func (sc *scanner) scanval() {
 	r := sc.get()
 
@@ -152,6 +257,25 @@ func (sc *scanner) scanval() {
 		r = sc.get()
 	}
 
+	if classify(r) == tSTRING {
+		lit, ok := sc.scanstring()
+
+		if !ok {
+			sc.err("unterminated string literal")
+			return
+		}
+
+		val, err := unquote(lit)
+
+		if err != nil {
+			sc.err(err.Error())
+			return
+		}
+
+		sc.val = val
+		return
+	}
+
 	sc.startLit()
 
 	for r != '\n' {
@@ -162,10 +286,76 @@ func (sc *scanner) scanval() {
 	sc.val = sc.stopLit()
 }
 
+func (sc *scanner) scansection() {
+	sc.subsection = ""
+
+	r := sc.get()
+
+	for r == ' ' || r == '\t' {
+		r = sc.get()
+	}
+
+	if !isLetter(r) {
+		sc.err(fmt.Sprintf("unexpected token %s, expected section name", string(r)))
+		sc.skipline()
+		return
+	}
+
+	sc.startLit()
+
+	for isLetter(r) {
+		r = sc.get()
+	}
+	sc.unget()
+
+	sc.section = sc.stopLit()
+
+	r = sc.get()
+
+	for r == ' ' || r == '\t' {
+		r = sc.get()
+	}
+
+	if classify(r) == tSTRING {
+		lit, ok := sc.scanstring()
+
+		if !ok {
+			sc.err("unterminated string literal")
+			sc.skipline()
+			return
+		}
+
+		sub, err := unquote(lit)
+
+		if err != nil {
+			sc.err(err.Error())
+			sc.skipline()
+			return
+		}
+
+		sc.subsection = sub
+
+		r = sc.get()
+
+		for r == ' ' || r == '\t' {
+			r = sc.get()
+		}
+	}
+
+	if classify(r) != tRBRACK {
+		sc.err(fmt.Sprintf("unexpected token %s, expected ]", string(r)))
+		sc.skipline()
+		return
+	}
+
+	sc.insection = true
+}
+
 func (sc *scanner) next() {
 redo:
 	sc.key = sc.key[0:0]
 	sc.val = sc.val[0:0]
+	sc.insection = false
 
 	r := sc.get()
 
@@ -183,6 +373,15 @@ redo:
 		goto redo
 	}
 
+	if classify(r) == tLBRACK {
+		sc.scansection()
+
+		if !sc.insection {
+			goto redo
+		}
+		return
+	}
+
 	if !isLetter(r) {
 		goto err
 	}
@@ -199,7 +398,6 @@ redo:
 		goto err
 	}
 
-	sc.get()
 	sc.scanval()
 	return
 
@@ -227,6 +425,8 @@ func (e errs) Error() string {
 
 func (v *varset) String() string { return "" }
 
+// Set implements flag.Value. A dotted key such as database.primary.host
+// creates nested maps so it composes with sectioned varfiles.
 func (v *varset) Set(s string) error {
 	parts := strings.SplitN(s, "=", 2)
 
@@ -235,30 +435,230 @@ func (v *varset) Set(s string) error {
 	}
 
 	if (*v) == nil {
-		(*v) = make(map[string]string)
+		(*v) = make(map[string]interface{})
 	}
 
-	key := parts[0]
+	keys := strings.Split(parts[0], ".")
 	val := parts[1]
 
-	(*v)[key] = val
+	m := map[string]interface{}(*v)
+
+	for i, key := range keys {
+		if i == len(keys)-1 {
+			m[key] = val
+			break
+		}
+
+		sub, ok := m[key].(map[string]interface{})
+
+		if !ok {
+			sub = make(map[string]interface{})
+			m[key] = sub
+		}
+		m = sub
+	}
 	return nil
 }
 
-func decodeVarfile(r io.Reader, errh func(int, int, string)) map[string]string {
+func sectionMap(root map[string]interface{}, section, subsection string) map[string]interface{} {
+	sm, ok := root[section].(map[string]interface{})
+
+	if !ok {
+		sm = make(map[string]interface{})
+		root[section] = sm
+	}
+
+	if subsection == "" {
+		return sm
+	}
+
+	ssm, ok := sm[subsection].(map[string]interface{})
+
+	if !ok {
+		ssm = make(map[string]interface{})
+		sm[subsection] = ssm
+	}
+	return ssm
+}
+
+func decodeVarfile(r io.Reader, errh func(int, int, string)) map[string]interface{} {
 	src := newSource(r, errh)
 	sc := newScanner(src)
 
-	m := make(map[string]string)
+	m := make(map[string]interface{})
+	cur := m
 
 	for !sc.eof {
-		m[sc.key] = sc.val
+		if sc.insection {
+			cur = sectionMap(m, sc.section, sc.subsection)
+		} else if sc.key != "" {
+			cur[sc.key] = sc.val
+		}
 		sc.next()
 	}
 	return m
 }
 
-func loadVarfile(path string) (map[string]string, error) {
+// Decoder implementations are registered in decoderForExt/decoderForFormat.
+type Decoder interface {
+	Decode(r io.Reader) (map[string]interface{}, error)
+}
+
+// nativeDecoder wraps decodeVarfile as a Decoder.
+type nativeDecoder struct{}
+
+func (nativeDecoder) Decode(r io.Reader) (map[string]interface{}, error) {
+	errs := errs(make([]string, 0))
+
+	m := decodeVarfile(r, func(line, col int, msg string) {
+		errs = append(errs, fmt.Sprintf("%d:%d - %s", line, col, msg))
+	})
+	return m, errs.err()
+}
+
+type jsonDecoder struct{}
+
+func (jsonDecoder) Decode(r io.Reader) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type yamlDecoder struct{}
+
+func (yamlDecoder) Decode(r io.Reader) (map[string]interface{}, error) {
+	var raw map[string]interface{}
+
+	if err := yaml.NewDecoder(r).Decode(&raw); err != nil {
+		if err == io.EOF {
+			return map[string]interface{}{}, nil
+		}
+		return nil, err
+	}
+
+	m, _ := normalizeYAML(raw).(map[string]interface{})
+	return m, nil
+}
+
+// normalizeYAML converts the map[interface{}]interface{} values yaml.v2
+// produces into map[string]interface{}, to satisfy the type assertions
+// in mergeVars.
+func normalizeYAML(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(vv))
+
+		for k, val := range vv {
+			m[fmt.Sprintf("%v", k)] = normalizeYAML(val)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(vv))
+
+		for k, val := range vv {
+			m[k] = normalizeYAML(val)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(vv))
+
+		for i, val := range vv {
+			s[i] = normalizeYAML(val)
+		}
+		return s
+	default:
+		return v
+	}
+}
+
+type tomlDecoder struct{}
+
+func (tomlDecoder) Decode(r io.Reader) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+
+	if _, err := toml.DecodeReader(r, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// dotenvDecoder supports an optional leading `export` and ${VAR}/$VAR
+// expansion against the process environment.
+type dotenvDecoder struct{}
+
+func (dotenvDecoder) Decode(r io.Reader) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+
+	sc := bufio.NewScanner(r)
+	line := 0
+
+	for sc.Scan() {
+		line++
+
+		text := strings.TrimSpace(sc.Text())
+
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		text = strings.TrimPrefix(text, "export ")
+
+		parts := strings.SplitN(text, "=", 2)
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: invalid entry %q, must be KEY=VALUE", line, text)
+		}
+
+		key := strings.TrimSpace(parts[0])
+		val := strings.TrimSpace(parts[1])
+
+		m[key] = os.Expand(val, os.Getenv)
+	}
+
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// decoderForExt falls back to nativeDecoder for an unrecognised extension,
+// so existing varfiles keep working regardless of name.
+func decoderForExt(ext string) Decoder {
+	switch ext {
+	case "json":
+		return jsonDecoder{}
+	case "yaml", "yml":
+		return yamlDecoder{}
+	case "toml":
+		return tomlDecoder{}
+	case "env":
+		return dotenvDecoder{}
+	default:
+		return nativeDecoder{}
+	}
+}
+
+func decoderForFormat(format string) (Decoder, error) {
+	switch format {
+	case "", "native", "vars":
+		return nativeDecoder{}, nil
+	case "json":
+		return jsonDecoder{}, nil
+	case "yaml", "yml":
+		return yamlDecoder{}, nil
+	case "toml":
+		return tomlDecoder{}, nil
+	case "env", "dotenv":
+		return dotenvDecoder{}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func loadVarfile(path, format string) (map[string]interface{}, error) {
 	f, err := os.Open(path)
 
 	if err != nil {
@@ -267,70 +667,585 @@ func loadVarfile(path string) (map[string]string, error) {
 
 	defer f.Close()
 
-	errs := errs(make([]string, 0))
+	dec, err := decoderFor(path, format)
 
-	m := decodeVarfile(f, func(line, col int, msg string) {
-		errs = append(errs, fmt.Sprintf("%s,%d:%d - %s", path, line, col, msg))
-	})
-	return m, errs.err()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	m, err := dec.Decode(f)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return m, nil
 }
 
-func main() {
+func decoderFor(path, format string) (Decoder, error) {
+	if format != "" {
+		return decoderForFormat(format)
+	}
+	return decoderForExt(strings.TrimPrefix(filepath.Ext(path), ".")), nil
+}
+
+func isZero(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	return reflect.ValueOf(v).IsZero()
+}
+
+// resolveInclude joins path onto baseDir and rejects the result if it
+// escapes baseDir, so include/includeTemplate can't read outside the
+// tree being rendered.
+func resolveInclude(baseDir, path string) (string, error) {
+	full := filepath.Join(baseDir, path)
+
+	rel, err := filepath.Rel(baseDir, full)
+
+	if err != nil {
+		return "", err
+	}
+
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("include: %q escapes %s", path, baseDir)
+	}
+	return full, nil
+}
+
+// buildFuncMap resolves include/includeTemplate paths against baseDir, so
+// directory-mode renders cannot read outside the tree being rendered.
+func buildFuncMap(baseDir string) template.FuncMap {
+	var fm template.FuncMap
+
+	fm = template.FuncMap{
+		"upper":   strings.ToUpper,
+		"lower":   strings.ToLower,
+		"title":   strings.Title,
+		"trim":    strings.TrimSpace,
+		"replace": func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"split":   func(sep, s string) []string { return strings.Split(s, sep) },
+		"join":    func(sep string, s []string) string { return strings.Join(s, sep) },
+		"quote":   strconv.Quote,
+
+		"toJSON": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"toYAML": func(v interface{}) (string, error) {
+			b, err := yaml.Marshal(v)
+			return string(b), err
+		},
+		"toTOML": func(v interface{}) (string, error) {
+			var buf bytes.Buffer
+			err := toml.NewEncoder(&buf).Encode(v)
+			return buf.String(), err
+		},
+		"b64enc": func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"b64dec": func(s string) (string, error) {
+			b, err := base64.StdEncoding.DecodeString(s)
+			return string(b), err
+		},
+
+		"base": filepath.Base,
+		"dir":  filepath.Dir,
+		"ext":  filepath.Ext,
+
+		"env": os.Getenv,
+		"envOr": func(name, def string) string {
+			if v, ok := os.LookupEnv(name); ok {
+				return v
+			}
+			return def
+		},
+
+		"include": func(path string) (string, error) {
+			full, err := resolveInclude(baseDir, path)
+
+			if err != nil {
+				return "", err
+			}
+
+			b, err := ioutil.ReadFile(full)
+			return string(b), err
+		},
+		"includeTemplate": func(path string, data interface{}) (string, error) {
+			full, err := resolveInclude(baseDir, path)
+
+			if err != nil {
+				return "", err
+			}
+
+			b, err := ioutil.ReadFile(full)
+
+			if err != nil {
+				return "", err
+			}
+
+			t, err := template.New(path).Funcs(fm).Parse(string(b))
+
+			if err != nil {
+				return "", err
+			}
+
+			var buf bytes.Buffer
+
+			if err := t.Execute(&buf, data); err != nil {
+				return "", err
+			}
+			return buf.String(), nil
+		},
+
+		"default": func(def, v interface{}) interface{} {
+			if isZero(v) {
+				return def
+			}
+			return v
+		},
+		"required": func(msg string, v interface{}) (interface{}, error) {
+			if isZero(v) {
+				return nil, errors.New(msg)
+			}
+			return v, nil
+		},
+	}
+	return fm
+}
+
+// filterFuncMap mutates fm in place rather than building a disjoint map,
+// so closures over fm captured before filtering (such as includeTemplate
+// in buildFuncMap) observe the same restricted set.
+func filterFuncMap(fm template.FuncMap, allow, deny []string) template.FuncMap {
+	if len(allow) > 0 {
+		keep := make(map[string]bool, len(allow))
+
+		for _, name := range allow {
+			keep[name] = true
+		}
+
+		for name := range fm {
+			if !keep[name] {
+				delete(fm, name)
+			}
+		}
+	}
+
+	for _, name := range deny {
+		delete(fm, name)
+	}
+	return fm
+}
+
+// renderBuf executes the set's only template if name is empty
+// (single-file and stdin mode).
+func renderBuf(t *template.Template, name string, vars varset) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+
+	var err error
+
+	if name == "" {
+		err = t.Execute(&buf, vars)
+	} else {
+		err = t.ExecuteTemplate(&buf, name, vars)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+func renderWriter(t *template.Template, name string, vars varset, w io.Writer) error {
+	buf, err := renderBuf(t, name, vars)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, buf)
+	return err
+}
+
+// renderToFile writes nothing to dst if rendering fails.
+func renderToFile(t *template.Template, name string, vars varset, dst string) error {
+	buf, err := renderBuf(t, name, vars)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, buf.Bytes(), 0644)
+}
+
+// renderSingle reads from stdin if path is "-", and renders to stdout if
+// out is empty.
+func renderSingle(path, out string, vars varset, fm template.FuncMap) error {
 	var (
-		vars    varset
-		varfile string
+		b    []byte
+		err  error
+		name = path
 	)
 
-	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
-	fs.Var(&vars, "var","set a variable, value should be in format of key=value")
-	fs.StringVar(&varfile, "file", "", "the file to read variables from")
-	fs.Parse(os.Args[1:])
+	if path == "-" {
+		name = "stdin"
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(path)
+	}
 
-	args := fs.Args()
+	if err != nil {
+		return err
+	}
 
-	if len(args) == 0 {
-		fmt.Fprintf(os.Stderr, "usage: %s [-file file] [-var key=value] <template>\n", os.Args[0])
-		os.Exit(1)
+	t, err := template.New(name).Funcs(fm).Parse(string(b))
+
+	if err != nil {
+		return err
+	}
+
+	if out == "" {
+		return renderWriter(t, "", vars, os.Stdout)
 	}
+	return renderToFile(t, "", vars, out)
+}
 
-	if varfile != "" {
-		m, err := loadVarfile(varfile)
+func collectTemplates(dir, match string) ([]string, error) {
+	var files []string
 
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "%s: failed to load variables from file: %s", os.Args[0], err)
-			os.Exit(1)
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		ok, err := filepath.Match(match, filepath.Base(path))
+
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// renderDir names each template by path relative to dir, so two files
+// sharing a basename in different subdirectories don't collide.
+func renderDir(dir, out, match string, vars varset, failFast bool, fm template.FuncMap) error {
+	files, err := collectTemplates(dir, match)
+
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		return fmt.Errorf("no files matching %q in %s", match, dir)
+	}
+
+	t := template.New("").Funcs(fm)
+
+	rels := make([]string, len(files))
+
+	for i, f := range files {
+		rel, err := filepath.Rel(dir, f)
+
+		if err != nil {
+			return err
+		}
+		rels[i] = rel
+
+		b, err := ioutil.ReadFile(f)
+
+		if err != nil {
+			return err
+		}
+
+		if _, err := t.New(rel).Parse(string(b)); err != nil {
+			return err
+		}
+	}
+
+	batch := errs(make([]string, 0))
+
+	for i, f := range files {
+		rel := rels[i]
+		dst := filepath.Join(out, strings.TrimSuffix(rel, ".tmpl"))
+
+		if err := renderToFile(t, rel, vars, dst); err != nil {
+			if failFast {
+				return fmt.Errorf("%s: %s", f, err)
+			}
+			batch = append(batch, fmt.Sprintf("%s: %s", f, err))
+		}
+	}
+	return batch.err()
+}
+
+// mergeVars descends into nested maps instead of overwriting them
+// wholesale so sectioned varfiles compose. With strict, a key present in
+// both dst and src is an error instead of letting src silently win.
+func mergeVars(dst, src map[string]interface{}, strict bool) error {
+	for k, v := range src {
+		sub, ok := v.(map[string]interface{})
+
+		if !ok {
+			if _, exists := dst[k]; exists && strict {
+				return fmt.Errorf("duplicate key %q", k)
+			}
+			dst[k] = v
+			continue
+		}
+
+		dsub, ok := dst[k].(map[string]interface{})
+
+		if !ok {
+			if _, exists := dst[k]; exists && strict {
+				return fmt.Errorf("duplicate key %q", k)
+			}
+			dsub = make(map[string]interface{})
+			dst[k] = dsub
+		}
+
+		if err := mergeVars(dsub, sub, strict); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// strlist appends each repeated flag occurrence in the order given on
+// the command line.
+type strlist []string
+
+func (f *strlist) String() string { return "" }
+
+func (f *strlist) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// loadVars merges -var flags in last so they always win over varfiles.
+func loadVars(files strlist, format string, strict bool, flagVars varset) (varset, error) {
+	merged := make(map[string]interface{})
+
+	for _, path := range files {
+		m, err := loadVarfile(path, format)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to load variables from file: %s", err)
 		}
 
-		if vars == nil {
-			vars = make(map[string]string)
+		if err := mergeVars(merged, m, strict); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
 		}
+	}
+
+	if flagVars != nil {
+		mergeVars(merged, flagVars, false)
+	}
+	return merged, nil
+}
 
-		for k, v := range m {
-			vars[k] = v
+func baseDirFor(target string) string {
+	if target == "-" {
+		return "."
+	}
+
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		return target
+	}
+	return filepath.Dir(target)
+}
+
+func renderTarget(target, out, match string, vars varset, failFast bool, fm template.FuncMap) error {
+	if target != "-" {
+		if info, err := os.Stat(target); err == nil && info.IsDir() {
+			if out == "" {
+				return errors.New("-out DIR is required when <template> is a directory")
+			}
+			return renderDir(target, out, match, vars, failFast, fm)
 		}
 	}
+	return renderSingle(target, out, vars, fm)
+}
+
+// watchPaths treats any change under target as relevant in directory
+// mode, since new files may start matching match.
+func watchPaths(target string, files strlist) (dirs map[string]bool, paths map[string]bool, dirMode bool) {
+	dirs = make(map[string]bool)
+	paths = make(map[string]bool)
+
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		dirMode = true
+		dirs[target] = true
+
+		filepath.Walk(target, func(p string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				dirs[p] = true
+			}
+			return nil
+		})
+	} else {
+		paths[filepath.Clean(target)] = true
+		dirs[filepath.Dir(target)] = true
+	}
 
-	var t *template.Template
+	for _, f := range files {
+		paths[filepath.Clean(f)] = true
+		dirs[filepath.Dir(f)] = true
+	}
+	return
+}
 
-	b, err := ioutil.ReadFile(args[0])
+// runWatch debounces bursts of events by delay. SIGHUP forces an
+// immediate re-render; SIGINT and SIGTERM stop the watch cleanly.
+func runWatch(target, out, match string, files strlist, format string, strict, failFast bool, flagVars varset, delay time.Duration, fm template.FuncMap) error {
+	watcher, err := fsnotify.NewWatcher()
 
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s: failed to read template file: %s\n", os.Args[0], err)
+		return err
+	}
+	defer watcher.Close()
+
+	dirs, paths, dirMode := watchPaths(target, files)
+
+	for d := range dirs {
+		if err := watcher.Add(d); err != nil {
+			return err
+		}
+	}
+
+	render := func() {
+		vars, err := loadVars(files, format, strict, flagVars)
+
+		if err == nil {
+			err = renderTarget(target, out, match, vars, failFast, fm)
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			return
+		}
+		fmt.Fprintln(os.Stderr, "ok")
+	}
+
+	relevant := func(name string) bool {
+		name = filepath.Clean(name)
+
+		if dirMode && strings.HasPrefix(name, filepath.Clean(target)) {
+			return true
+		}
+		return paths[name]
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	var timer *time.Timer
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			if !relevant(event.Name) {
+				continue
+			}
+
+			if timer == nil {
+				timer = time.AfterFunc(delay, render)
+			} else {
+				timer.Reset(delay)
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+
+		case s := <-sig:
+			if s == syscall.SIGHUP {
+				render()
+				continue
+			}
+			return nil
+		}
+	}
+}
+
+func main() {
+	var (
+		vars       varset
+		files      strlist
+		strict     bool
+		format     string
+		out        string
+		match      string
+		failFast   bool
+		watch      bool
+		watchDelay time.Duration
+		funcAllow  strlist
+		funcDeny   strlist
+	)
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.Var(&vars, "var", "set a variable, value should be in format of key=value")
+	fs.Var(&files, "file", "the file to read variables from, may be given multiple times")
+	fs.BoolVar(&strict, "strict", false, "treat a duplicate key across files as an error instead of letting the later file win")
+	fs.StringVar(&format, "format", "", "force the varfile decoder (native, json, yaml, toml, env) instead of detecting it from the file extension")
+	fs.StringVar(&out, "out", "", "write output to this file, or to this directory when <template> is a directory (defaults to stdout)")
+	fs.StringVar(&match, "match", "*.tmpl", "glob matched against file names when <template> is a directory")
+	fs.BoolVar(&failFast, "fail-fast", false, "in directory mode, stop at the first render error instead of reporting them all at the end")
+	fs.BoolVar(&watch, "watch", false, "re-render whenever the template or a varfile changes")
+	fs.DurationVar(&watchDelay, "watch-delay", 100*time.Millisecond, "debounce delay before re-rendering in -watch mode")
+	fs.Var(&funcAllow, "func-allow", "only expose this template func, may be given multiple times (default: all)")
+	fs.Var(&funcDeny, "func-deny", "hide this template func, may be given multiple times")
+	fs.Parse(os.Args[1:])
+
+	args := fs.Args()
+
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s [-file file]... [-format name] [-var key=value] [-strict] [-out path] [-match glob] [-fail-fast] [-watch] [-watch-delay dur] [-func-allow name] [-func-deny name] <template|dir|->\n", os.Args[0])
 		os.Exit(1)
 	}
 
-	t, err = template.New(args[0]).Parse(string(b))
+	target := args[0]
 
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s: failed to parse template: %s\n", os.Args[0], err)
+	if watch && target == "-" {
+		fmt.Fprintf(os.Stderr, "%s: -watch cannot be used when <template> is -\n", os.Args[0])
 		os.Exit(1)
 	}
 
-	var buf bytes.Buffer
+	fm := filterFuncMap(buildFuncMap(baseDirFor(target)), funcAllow, funcDeny)
+
+	mergedVars, err := loadVars(files, format, strict, vars)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+		os.Exit(1)
+	}
 
-	if err := t.Execute(&buf, vars); err != nil {
-		fmt.Fprintf(os.Stderr, "%s: failed to execute template: %s\n", os.Args[0], err)
+	if err := renderTarget(target, out, match, mergedVars, failFast, fm); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
 		os.Exit(1)
 	}
-	io.Copy(os.Stdout, &buf)
+
+	if watch {
+		if err := runWatch(target, out, match, files, format, strict, failFast, vars, watchDelay, fm); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+			os.Exit(1)
+		}
+	}
 }